@@ -5,182 +5,962 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cloudfoundry/cli/plugin"
 	"github.com/concourse/autopilot/rewind"
+	"gopkg.in/yaml.v2"
 )
 
+// logger is the active Logger for this invocation, selected from --log-format
+// before any flag parsing that could fail (and thus call fatalIf) happens.
+var logger Logger = &textLogger{}
+
 func fatalIf(err error) {
 	if err != nil {
-		fmt.Fprintln(os.Stdout, "error:", err)
+		logger.Error(err.Error())
 		os.Exit(1)
 	}
-}
+}
+
+// Logger is how AutopilotPlugin reports progress and pipeline events. Text
+// mode matches autopilot's historical console output; JSON mode emits one
+// event object per line for consumption by CI pipelines.
+type Logger interface {
+	Info(message string)
+	Warn(message string)
+	Error(message string)
+	Step(name, status string, fields map[string]interface{})
+}
+
+func newLogger(format string) Logger {
+	if format == "json" {
+		return &jsonLogger{}
+	}
+	return &textLogger{}
+}
+
+// detectLogFormat scans for --log-format (or Go flag package's equivalent
+// single-dash -log-format) before flags are parsed, since a parse failure
+// itself needs to go through the right logger.
+func detectLogFormat(args []string) string {
+	for i := 2; i < len(args); i++ {
+		switch {
+		case args[i] == "--log-format" || args[i] == "-log-format":
+			if i+1 < len(args) {
+				return args[i+1]
+			}
+		case strings.HasPrefix(args[i], "--log-format="):
+			return strings.TrimPrefix(args[i], "--log-format=")
+		case strings.HasPrefix(args[i], "-log-format="):
+			return strings.TrimPrefix(args[i], "-log-format=")
+		}
+	}
+	return "text"
+}
+
+type textLogger struct{}
+
+func (textLogger) Info(message string)  { fmt.Println(message) }
+func (textLogger) Warn(message string)  { fmt.Fprintln(os.Stdout, "warning:", message) }
+func (textLogger) Error(message string) { fmt.Fprintln(os.Stdout, "error:", message) }
+func (textLogger) Step(name, status string, fields map[string]interface{}) {
+	if message, ok := fields["message"].(string); ok {
+		fmt.Println(message)
+	}
+}
+
+type jsonLogger struct{}
+
+func (jsonLogger) Info(message string) {
+	jsonLogger{}.print(map[string]interface{}{"level": "info", "message": message})
+}
+func (jsonLogger) Warn(message string) {
+	jsonLogger{}.print(map[string]interface{}{"level": "warn", "message": message})
+}
+func (jsonLogger) Error(message string) {
+	jsonLogger{}.print(map[string]interface{}{"level": "error", "message": message})
+}
+func (jsonLogger) Step(name, status string, fields map[string]interface{}) {
+	event := map[string]interface{}{"action": name, "status": status}
+	for key, value := range fields {
+		if key == "status" {
+			continue
+		}
+		event[key] = value
+	}
+	jsonLogger{}.print(event)
+}
+func (jsonLogger) print(event map[string]interface{}) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	fmt.Println(string(data))
+}
+
+func main() {
+	plugin.Start(&AutopilotPlugin{})
+}
+
+type AutopilotPlugin struct{}
+
+func rollbackAppName(appName string) string {
+	return fmt.Sprintf("%s-rollback", appName)
+}
+
+func revisionAppName(appName string, version int) string {
+	return fmt.Sprintf("%s-v%d", appName, version)
+}
+
+// Action is a single named step in a zero-downtime push or rollback. Unlike a
+// bare rewind.Action, it knows how to describe itself so --dry-run can render
+// the plan without ever calling ToRewindAction (and therefore without
+// touching the CF API).
+type Action interface {
+	Describe() string
+	DescribeReverse() string // "" if this step has no compensating action
+	ToRewindAction() rewind.Action
+
+	// Name and LogFields feed logger.Step so each rewind action's forward
+	// and reverse execution shows up as a structured event.
+	Name() string
+	LogFields() map[string]interface{}
+}
+
+func toRewindActions(actions []Action) []rewind.Action {
+	rewindActions := make([]rewind.Action, len(actions))
+	for i, action := range actions {
+		rewindActions[i] = instrument(action)
+	}
+	return rewindActions
+}
+
+// instrument wraps an action's Forward/ReversePrevious so every execution is
+// timed and reported through logger.Step, regardless of --log-format.
+func instrument(action Action) rewind.Action {
+	base := action.ToRewindAction()
+
+	instrumented := rewind.Action{
+		Forward: func() error {
+			return runLogged(action, "forward", base.Forward)
+		},
+	}
+
+	if base.ReversePrevious != nil {
+		instrumented.ReversePrevious = func() error {
+			return runLogged(action, "reverse", base.ReversePrevious)
+		}
+	}
+
+	return instrumented
+}
+
+func runLogged(action Action, phase string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	duration := time.Since(start)
+
+	status := "ok"
+	if err != nil {
+		status = "error"
+	}
+
+	fields := action.LogFields()
+	if fields == nil {
+		fields = map[string]interface{}{}
+	}
+	fields["phase"] = phase
+	fields["duration_ms"] = duration.Milliseconds()
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+
+	logger.Step(action.Name(), status, fields)
+
+	return err
+}
+
+func printDryRunPlan(actionList []Action) {
+	fmt.Println("Dry run: the following steps would be performed (no API calls will be made):")
+	for i, action := range actionList {
+		fmt.Printf("  %d. %s\n", i+1, action.Describe())
+		if reverse := action.DescribeReverse(); reverse != "" {
+			fmt.Printf("     on failure: %s\n", reverse)
+		}
+	}
+}
+
+type RenameAction struct {
+	Repo     *ApplicationRepo
+	From, To string
+}
+
+func (a *RenameAction) Describe() string {
+	return fmt.Sprintf("rename %s -> %s", a.From, a.To)
+}
+
+func (a *RenameAction) DescribeReverse() string {
+	return fmt.Sprintf("rename %s -> %s", a.To, a.From)
+}
+
+func (a *RenameAction) ToRewindAction() rewind.Action {
+	return rewind.Action{
+		Forward: func() error {
+			return a.Repo.RenameApplication(a.From, a.To)
+		},
+		ReversePrevious: func() error {
+			return a.Repo.RenameApplication(a.To, a.From)
+		},
+	}
+}
+
+func (a *RenameAction) Name() string { return "rename" }
+func (a *RenameAction) LogFields() map[string]interface{} {
+	return map[string]interface{}{"from": a.From, "to": a.To}
+}
+
+// PushAction pushes AppName from ManifestPath/AppPath. If RevisionName is
+// set, a failed start is reversed by deleting the half-pushed app and
+// renaming the previous revision back into place. If DeleteOnReverse is set
+// instead (canary pushes, which have no RevisionName to fall back to), a
+// failed push is reversed by simply deleting AppName.
+type PushAction struct {
+	Repo                           *ApplicationRepo
+	AppName, ManifestPath, AppPath string
+	RevisionName                   string
+	NoRoute                        bool
+	DeleteOnReverse                bool
+}
+
+func (a *PushAction) Describe() string {
+	if a.NoRoute {
+		return fmt.Sprintf("push %s from manifest %s (no route)", a.AppName, a.ManifestPath)
+	}
+	return fmt.Sprintf("push %s from manifest %s", a.AppName, a.ManifestPath)
+}
+
+func (a *PushAction) DescribeReverse() string {
+	if a.RevisionName != "" {
+		return fmt.Sprintf("delete %s and rename %s -> %s", a.AppName, a.RevisionName, a.AppName)
+	}
+	if a.DeleteOnReverse {
+		return fmt.Sprintf("delete %s", a.AppName)
+	}
+	return ""
+}
+
+func (a *PushAction) ToRewindAction() rewind.Action {
+	action := rewind.Action{
+		Forward: func() error {
+			return a.Repo.PushApplication(a.AppName, a.ManifestPath, a.AppPath, a.NoRoute)
+		},
+	}
+
+	if a.RevisionName != "" {
+		action.ReversePrevious = func() error {
+			// If the app cannot start we'll have a lingering application
+			// We delete this application so that the rename can succeed
+			a.Repo.DeleteApplication(a.AppName)
+
+			return a.Repo.RenameApplication(a.RevisionName, a.AppName)
+		}
+	} else if a.DeleteOnReverse {
+		action.ReversePrevious = func() error {
+			return a.Repo.DeleteApplication(a.AppName)
+		}
+	}
+
+	return action
+}
+
+func (a *PushAction) Name() string { return "push" }
+func (a *PushAction) LogFields() map[string]interface{} {
+	return map[string]interface{}{
+		"app_name":      a.AppName,
+		"manifest_path": a.ManifestPath,
+		"no_route":      a.NoRoute,
+	}
+}
+
+type StartAction struct {
+	Repo    *ApplicationRepo
+	AppName string
+}
+
+func (a *StartAction) Describe() string        { return fmt.Sprintf("start %s", a.AppName) }
+func (a *StartAction) DescribeReverse() string { return "" }
+func (a *StartAction) ToRewindAction() rewind.Action {
+	return rewind.Action{
+		Forward: func() error {
+			return a.Repo.StartApplication(a.AppName)
+		},
+	}
+}
+
+func (a *StartAction) Name() string { return "start" }
+func (a *StartAction) LogFields() map[string]interface{} {
+	return map[string]interface{}{"app_name": a.AppName}
+}
+
+type StopAction struct {
+	Repo    *ApplicationRepo
+	AppName string
+}
+
+func (a *StopAction) Describe() string        { return fmt.Sprintf("stop %s", a.AppName) }
+func (a *StopAction) DescribeReverse() string { return "" }
+func (a *StopAction) ToRewindAction() rewind.Action {
+	return rewind.Action{
+		Forward: func() error {
+			return a.Repo.StopApplication(a.AppName)
+		},
+	}
+}
+
+func (a *StopAction) Name() string { return "stop" }
+func (a *StopAction) LogFields() map[string]interface{} {
+	return map[string]interface{}{"app_name": a.AppName}
+}
+
+type DeleteAction struct {
+	Repo    *ApplicationRepo
+	AppName string
+}
+
+func (a *DeleteAction) Describe() string        { return fmt.Sprintf("delete %s", a.AppName) }
+func (a *DeleteAction) DescribeReverse() string { return "" }
+func (a *DeleteAction) ToRewindAction() rewind.Action {
+	return rewind.Action{
+		Forward: func() error {
+			return a.Repo.DeleteApplication(a.AppName)
+		},
+	}
+}
+
+func (a *DeleteAction) Name() string { return "delete" }
+func (a *DeleteAction) LogFields() map[string]interface{} {
+	return map[string]interface{}{"app_name": a.AppName}
+}
+
+// WaitAction polls an app's instance stats until every instance reports
+// RUNNING or Timeout elapses. A timeout is returned as an error, and the
+// reverse step then deletes AppName and renames RevisionName back into place.
+type WaitAction struct {
+	Repo         *ApplicationRepo
+	AppName      string
+	RevisionName string
+	Timeout      time.Duration
+}
+
+func (a *WaitAction) Describe() string {
+	return fmt.Sprintf("wait up to %s for %s instances to report RUNNING", a.Timeout, a.AppName)
+}
+func (a *WaitAction) DescribeReverse() string {
+	return fmt.Sprintf("delete %s and rename %s -> %s", a.AppName, a.RevisionName, a.AppName)
+}
+func (a *WaitAction) ToRewindAction() rewind.Action {
+	return rewind.Action{
+		Forward: func() error {
+			return a.Repo.WaitForHealthy(a.AppName, a.Timeout)
+		},
+		ReversePrevious: func() error {
+			a.Repo.DeleteApplication(a.AppName)
+
+			return a.Repo.RenameApplication(a.RevisionName, a.AppName)
+		},
+	}
+}
+
+func (a *WaitAction) Name() string { return "wait" }
+func (a *WaitAction) LogFields() map[string]interface{} {
+	return map[string]interface{}{"app_name": a.AppName, "timeout": a.Timeout.String()}
+}
+
+// PruneAction trims an app's revision history down to MaxHistory entries.
+type PruneAction struct {
+	Repo       *ApplicationRepo
+	AppName    string
+	MaxHistory int
+}
+
+func (a *PruneAction) Describe() string {
+	return fmt.Sprintf("prune revisions of %s beyond the last %d", a.AppName, a.MaxHistory)
+}
+func (a *PruneAction) DescribeReverse() string { return "" }
+func (a *PruneAction) ToRewindAction() rewind.Action {
+	return rewind.Action{
+		Forward: func() error {
+			return a.Repo.PruneRevisions(a.AppName, a.MaxHistory)
+		},
+	}
+}
+
+func (a *PruneAction) Name() string { return "prune" }
+func (a *PruneAction) LogFields() map[string]interface{} {
+	return map[string]interface{}{
+		"app_name":    a.AppName,
+		"max_history": a.MaxHistory,
+		"message":     fmt.Sprintf("Pruning revisions of %s beyond the last %d.", a.AppName, a.MaxHistory),
+	}
+}
+
+// MapRouteAction maps Route onto AppName.
+type MapRouteAction struct {
+	Repo    *ApplicationRepo
+	AppName string
+	Route   Route
+}
+
+func (a *MapRouteAction) Describe() string {
+	return fmt.Sprintf("map route %s to %s", a.Route, a.AppName)
+}
+func (a *MapRouteAction) DescribeReverse() string {
+	return fmt.Sprintf("unmap route %s from %s", a.Route, a.AppName)
+}
+func (a *MapRouteAction) ToRewindAction() rewind.Action {
+	return rewind.Action{
+		Forward: func() error {
+			return a.Repo.MapRoute(a.AppName, a.Route)
+		},
+		ReversePrevious: func() error {
+			return a.Repo.UnmapRoute(a.AppName, a.Route)
+		},
+	}
+}
+
+func (a *MapRouteAction) Name() string { return "map-route" }
+func (a *MapRouteAction) LogFields() map[string]interface{} {
+	return map[string]interface{}{"app_name": a.AppName, "route": a.Route.String()}
+}
+
+// UnmapRouteAction unmaps Route from AppName.
+type UnmapRouteAction struct {
+	Repo    *ApplicationRepo
+	AppName string
+	Route   Route
+}
+
+func (a *UnmapRouteAction) Describe() string {
+	return fmt.Sprintf("unmap route %s from %s", a.Route, a.AppName)
+}
+func (a *UnmapRouteAction) DescribeReverse() string {
+	return fmt.Sprintf("map route %s to %s", a.Route, a.AppName)
+}
+func (a *UnmapRouteAction) ToRewindAction() rewind.Action {
+	return rewind.Action{
+		Forward: func() error {
+			return a.Repo.UnmapRoute(a.AppName, a.Route)
+		},
+		ReversePrevious: func() error {
+			return a.Repo.MapRoute(a.AppName, a.Route)
+		},
+	}
+}
+
+func (a *UnmapRouteAction) Name() string { return "unmap-route" }
+func (a *UnmapRouteAction) LogFields() map[string]interface{} {
+	return map[string]interface{}{"app_name": a.AppName, "route": a.Route.String()}
+}
+
+// CanaryStepAction scales CanaryName up and LiveName down to the instance
+// counts for one step of a canary rollout, waits StepInterval for traffic to
+// settle, then health-checks the canary side. On failure ReversePrevious
+// scales the live side back up to PreviousLiveInstances.
+type CanaryStepAction struct {
+	Repo                                                  *ApplicationRepo
+	CanaryName, LiveName                                  string
+	CanaryInstances, LiveInstances, PreviousLiveInstances int
+	StepInterval, Timeout                                 time.Duration
+}
+
+func (a *CanaryStepAction) Describe() string {
+	return fmt.Sprintf("scale %s to %d and %s to %d instances, wait %s, then check %s health for up to %s",
+		a.CanaryName, a.CanaryInstances, a.LiveName, a.LiveInstances, a.StepInterval, a.CanaryName, a.Timeout)
+}
+func (a *CanaryStepAction) DescribeReverse() string {
+	return fmt.Sprintf("scale %s back to %d instances", a.LiveName, a.PreviousLiveInstances)
+}
+func (a *CanaryStepAction) ToRewindAction() rewind.Action {
+	return rewind.Action{
+		Forward: func() error {
+			if err := a.Repo.ScaleApplication(a.CanaryName, a.CanaryInstances); err != nil {
+				return err
+			}
+			if err := a.Repo.ScaleApplication(a.LiveName, a.LiveInstances); err != nil {
+				return err
+			}
+
+			time.Sleep(a.StepInterval)
+
+			return a.Repo.WaitForHealthy(a.CanaryName, a.Timeout)
+		},
+		ReversePrevious: func() error {
+			return a.Repo.ScaleApplication(a.LiveName, a.PreviousLiveInstances)
+		},
+	}
+}
+
+func (a *CanaryStepAction) Name() string { return "canary-step" }
+func (a *CanaryStepAction) LogFields() map[string]interface{} {
+	return map[string]interface{}{
+		"canary_name":      a.CanaryName,
+		"live_name":        a.LiveName,
+		"canary_instances": a.CanaryInstances,
+		"live_instances":   a.LiveInstances,
+	}
+}
+
+// ScaleAction scales AppName to Instances. Used once the canary ramp is
+// complete to restore the old live app's instance count before it's parked
+// in revision history, so a later rollback to it doesn't silently come back
+// up with zero instances.
+type ScaleAction struct {
+	Repo      *ApplicationRepo
+	AppName   string
+	Instances int
+}
+
+func (a *ScaleAction) Describe() string {
+	return fmt.Sprintf("scale %s to %d instances", a.AppName, a.Instances)
+}
+func (a *ScaleAction) DescribeReverse() string { return "" }
+func (a *ScaleAction) ToRewindAction() rewind.Action {
+	return rewind.Action{
+		Forward: func() error {
+			return a.Repo.ScaleApplication(a.AppName, a.Instances)
+		},
+	}
+}
+
+func (a *ScaleAction) Name() string { return "scale" }
+func (a *ScaleAction) LogFields() map[string]interface{} {
+	return map[string]interface{}{"app_name": a.AppName, "instances": a.Instances}
+}
+
+func canaryAppName(appName string) string {
+	return fmt.Sprintf("%s-canary", appName)
+}
+
+// scaledInstances returns the number of instances that pct percent of total
+// rounds up to, clamped to [1, total].
+func scaledInstances(total, pct int) int {
+	instances := (total*pct + 99) / 100
+
+	if instances > total {
+		instances = total
+	}
+	if instances < 1 {
+		instances = 1
+	}
+
+	return instances
+}
+
+func parseCanarySteps(raw string) ([]int, error) {
+	var steps []int
+	for _, field := range strings.Split(raw, ",") {
+		pct, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("invalid --steps value %q: %s", raw, err)
+		}
+		steps = append(steps, pct)
+	}
+
+	return steps, nil
+}
+
+// HookPoint identifies a point in the zero-downtime push/rollback pipeline
+// where user-configured commands may be run.
+type HookPoint string
+
+const (
+	HookPrePush            HookPoint = "pre-push"
+	HookPostRename         HookPoint = "post-rename"
+	HookPostPush           HookPoint = "post-push"
+	HookPreDeleteVenerable HookPoint = "pre-delete-venerable"
+	HookPreRollback        HookPoint = "pre-rollback"
+	HookPostRollback       HookPoint = "post-rollback"
+)
+
+const hookEnvPrefix = "AUTOPILOT_HOOKS_"
+
+// LoadHooks collects hook commands declared either as AUTOPILOT_HOOKS_*
+// env entries on the manifest's applications, or in a sidecar autopilot.yml
+// living next to the manifest. The sidecar is appended after the manifest's
+// own hooks, in the order each is encountered, so both sources can combine.
+func LoadHooks(manifestPath string) (map[HookPoint][]string, error) {
+	hooks := map[HookPoint][]string{}
+
+	if manifestPath == "" {
+		return hooks, nil
+	}
+
+	if raw, err := ioutil.ReadFile(manifestPath); err == nil {
+		var manifest struct {
+			Applications []struct {
+				Env map[string]string `yaml:"env"`
+			} `yaml:"applications"`
+		}
+
+		if err := yaml.Unmarshal(raw, &manifest); err != nil {
+			return nil, err
+		}
+
+		for _, app := range manifest.Applications {
+			for key, value := range app.Env {
+				if point, ok := hookPointFromEnvKey(key); ok {
+					hooks[point] = append(hooks[point], value)
+				}
+			}
+		}
+	}
+
+	sidecarPath := filepath.Join(filepath.Dir(manifestPath), "autopilot.yml")
+	if raw, err := ioutil.ReadFile(sidecarPath); err == nil {
+		var sidecar struct {
+			Hooks map[HookPoint][]string `yaml:"hooks"`
+		}
+
+		if err := yaml.Unmarshal(raw, &sidecar); err != nil {
+			return nil, err
+		}
+
+		for point, commands := range sidecar.Hooks {
+			hooks[point] = append(hooks[point], commands...)
+		}
+	}
+
+	return hooks, nil
+}
+
+func hookPointFromEnvKey(key string) (HookPoint, bool) {
+	if !strings.HasPrefix(key, hookEnvPrefix) {
+		return "", false
+	}
+
+	suffix := strings.ToLower(strings.TrimPrefix(key, hookEnvPrefix))
+	return HookPoint(strings.Replace(suffix, "_", "-", -1)), true
+}
+
+func loadHooksIfEnabled(options AutopilotOptions) (map[HookPoint][]string, error) {
+	if options.DisableHooks {
+		return map[HookPoint][]string{}, nil
+	}
+
+	return LoadHooks(options.ManifestPath)
+}
+
+// appendHookAction adds a HookAction for point, but only when commands are
+// actually configured for it, so --dry-run plans stay free of no-op steps.
+func appendHookAction(actions []Action, point HookPoint, hooks map[HookPoint][]string) []Action {
+	commands := hooks[point]
+	if len(commands) == 0 {
+		return actions
+	}
+
+	return append(actions, &HookAction{Point: point, Commands: commands})
+}
+
+// HookAction runs a point's configured commands through the shell, in order,
+// failing on the first one that returns an error. It has no reverse step of
+// its own, so a failed hook is not compensated for.
+type HookAction struct {
+	Point    HookPoint
+	Commands []string
+}
+
+func (a *HookAction) Describe() string {
+	return fmt.Sprintf("run %s hooks: %s", a.Point, strings.Join(a.Commands, "; "))
+}
+func (a *HookAction) DescribeReverse() string { return "" }
+func (a *HookAction) ToRewindAction() rewind.Action {
+	return rewind.Action{
+		Forward: func() error {
+			for _, command := range a.Commands {
+				logger.Info(fmt.Sprintf("Running %s hook: %s", a.Point, command))
+
+				cmd := exec.Command("sh", "-c", command)
+				cmd.Stdout = os.Stdout
+				cmd.Stderr = os.Stderr
+
+				if err := cmd.Run(); err != nil {
+					return fmt.Errorf("%s hook %q failed: %s", a.Point, command, err)
+				}
+			}
+
+			return nil
+		},
+	}
+}
+
+func (a *HookAction) Name() string { return "hook" }
+func (a *HookAction) LogFields() map[string]interface{} {
+	return map[string]interface{}{"point": string(a.Point), "commands": a.Commands}
+}
+
+func getActionsForRollback(appName string, version int, appRepo *ApplicationRepo, options AutopilotOptions) []Action {
+	hooks, err := loadHooksIfEnabled(options)
+	fatalIf(err)
+
+	actions := appendHookAction(nil, HookPreRollback, hooks)
+
+	actions = append(actions,
+		&RenameAction{Repo: appRepo, From: appName, To: rollbackAppName(appName)},
+		&RenameAction{Repo: appRepo, From: revisionAppName(appName, version), To: appName},
+		&StartAction{Repo: appRepo, AppName: appName},
+	)
+
+	actions = appendHookAction(actions, HookPostRollback, hooks)
+
+	return append(actions, &DeleteAction{Repo: appRepo, AppName: rollbackAppName(appName)})
+}
+
+func getActionsForPush(appRepo *ApplicationRepo, args []string) ([]Action, bool) {
+	appName, manifestPath, appPath, options, err := ParseArgs(args)
+	fatalIf(err)
+
+	return buildPushActions(appRepo, appName, manifestPath, appPath, options)
+}
+
+// getActionsForCanary is the entry point for zero-downtime-canary: it parses
+// push-style args but forces the canary strategy regardless of --strategy.
+func getActionsForCanary(appRepo *ApplicationRepo, args []string) ([]Action, bool) {
+	appName, manifestPath, appPath, options, err := ParseArgs(args)
+	fatalIf(err)
+
+	options.Strategy = "canary"
+
+	return buildPushActions(appRepo, appName, manifestPath, appPath, options)
+}
+
+func buildPushActions(appRepo *ApplicationRepo, appName, manifestPath, appPath string, options AutopilotOptions) ([]Action, bool) {
+	appExists, err := appRepo.DoesAppExist(appName)
+	fatalIf(err)
+
+	if !appExists {
+		// There's no live app to shift traffic away from, so a first push is
+		// always a plain push regardless of strategy.
+		return getActionsForNewApp(appRepo, appName, manifestPath, appPath, options), options.DryRun
+	}
+
+	if options.Strategy == "canary" {
+		return getActionsForCanaryPush(appRepo, appName, manifestPath, appPath, options), options.DryRun
+	}
+
+	return getActionsForExistingApp(appRepo, appName, manifestPath, appPath, options), options.DryRun
+}
+
+// getActionsForCanaryPush pushes the new version under a distinct name,
+// maps it onto the live app's routes, then incrementally shifts instances
+// from the live app to the canary over options.CanarySteps before folding
+// the old app into the numbered revision history and renaming the canary
+// into its place, just like the rename strategy does.
+func getActionsForCanaryPush(appRepo *ApplicationRepo, appName, manifestPath, appPath string, options AutopilotOptions) []Action {
+	hooks, err := loadHooksIfEnabled(options)
+	fatalIf(err)
+
+	canaryName := canaryAppName(appName)
+
+	revisions, err := appRepo.ListRevisions(appName)
+	fatalIf(err)
+
+	nextVersion := 1
+	if len(revisions) > 0 {
+		nextVersion = revisions[len(revisions)-1] + 1
+	}
+	revisionName := revisionAppName(appName, nextVersion)
 
-func main() {
-	plugin.Start(&AutopilotPlugin{})
-}
+	totalInstances, err := appRepo.getAppInstanceCount(appName)
+	fatalIf(err)
+	if totalInstances < 1 {
+		totalInstances = 1
+	}
 
-type AutopilotPlugin struct{}
+	routes, err := appRepo.GetAppRoutes(appName)
+	fatalIf(err)
 
-func venerableAppName(appName string) string {
-	return fmt.Sprintf("%s-venerable", appName)
-}
+	actions := appendHookAction(nil, HookPrePush, hooks)
 
-func rollbackAppName(appName string) string {
-	return fmt.Sprintf("%s-rollback", appName)
-}
+	actions = append(actions, &PushAction{Repo: appRepo, AppName: canaryName, ManifestPath: manifestPath, AppPath: appPath, NoRoute: true, DeleteOnReverse: true})
+	actions = appendHookAction(actions, HookPostPush, hooks)
 
-func getActionsForRollback(appName string, appRepo *ApplicationRepo, args []string) []rewind.Action {
-	return []rewind.Action{
-		//Rename live app
-		{
-			Forward: func() error {
-				return appRepo.RenameApplication(appName, rollbackAppName(appName))
-			},
-			ReversePrevious: func() error {
-				return appRepo.RenameApplication(rollbackAppName(appName), appName)
-			},
-		},
-		//Rename venerable app
-		{
-			Forward: func() error {
-				return appRepo.RenameApplication(venerableAppName(appName), appName)
-			},
-			ReversePrevious: func() error {
-				return appRepo.RenameApplication(appName, venerableAppName(appName))
-			},
-		},
-		//Start rollback app
-		{
-			Forward: func() error {
-				return appRepo.StartApplication(appName)
+	for _, route := range routes {
+		actions = append(actions, &MapRouteAction{Repo: appRepo, AppName: canaryName, Route: route})
+	}
 
-			},
-		},
-		//Delete rolled back app
-		{
-			Forward: func() error {
-				return appRepo.DeleteApplication(rollbackAppName(appName))
-			},
-		},
+	previousLiveInstances := totalInstances
+	for _, pct := range options.CanarySteps {
+		canaryInstances := scaledInstances(totalInstances, pct)
+		liveInstances := totalInstances - canaryInstances
+		if liveInstances < 0 {
+			liveInstances = 0
+		}
+
+		actions = append(actions, &CanaryStepAction{
+			Repo:                  appRepo,
+			CanaryName:            canaryName,
+			LiveName:              appName,
+			CanaryInstances:       canaryInstances,
+			LiveInstances:         liveInstances,
+			PreviousLiveInstances: previousLiveInstances,
+			StepInterval:          options.StepInterval,
+			Timeout:               options.HealthTimeout,
+		})
+
+		previousLiveInstances = liveInstances
+	}
+
+	for _, route := range routes {
+		actions = append(actions, &UnmapRouteAction{Repo: appRepo, AppName: appName, Route: route})
 	}
+
+	// The ramp above scaled the old live app down (to 0 instances once a step
+	// reaches 100%); restore it
+	// before parking it in revision history so a later rollback to it comes
+	// back up running rather than silently at 0 instances.
+	actions = append(actions, &ScaleAction{Repo: appRepo, AppName: appName, Instances: totalInstances})
+
+	actions = appendHookAction(actions, HookPreDeleteVenerable, hooks)
+
+	actions = append(actions, &RenameAction{Repo: appRepo, From: appName, To: revisionName})
+	actions = append(actions, &RenameAction{Repo: appRepo, From: canaryName, To: appName})
+
+	if options.KeepExisting {
+		actions = append(actions, &StopAction{Repo: appRepo, AppName: revisionName})
+		return append(actions, &PruneAction{Repo: appRepo, AppName: appName, MaxHistory: options.MaxHistory})
+	}
+
+	actions = append(actions, &DeleteAction{Repo: appRepo, AppName: revisionName})
+	return append(actions, &PruneAction{Repo: appRepo, AppName: appName, MaxHistory: options.MaxHistory})
 }
 
-func getActionsForPush(appRepo *ApplicationRepo, args []string) []rewind.Action {
-	appName, manifestPath, appPath, options, err := ParseArgs(args)
+func getActionsForExistingApp(appRepo *ApplicationRepo, appName, manifestPath, appPath string, options AutopilotOptions) []Action {
+	hooks, err := loadHooksIfEnabled(options)
 	fatalIf(err)
 
-	appExists, err := appRepo.DoesAppExist(appName)
+	revisions, err := appRepo.ListRevisions(appName)
 	fatalIf(err)
 
-	if appExists {
-		return getActionsForExistingApp(appRepo, appName, manifestPath, appPath, options)
-	} else {
-		return getActionsForNewApp(appRepo, appName, manifestPath, appPath)
-	}
-}
-
-func getActionsForExistingApp(appRepo *ApplicationRepo, appName, manifestPath, appPath string, options AutopilotOptions) []rewind.Action {
-	return []rewind.Action{
-		// delete old version if it still exists
-		{
-			Forward: func() error {
-				appExists, err := appRepo.DoesAppExist(venerableAppName(appName))
-				fatalIf(err)
-				if(appExists) {
-					fmt.Println("Found old version of app running, deleting.")
-					return appRepo.DeleteApplication(venerableAppName(appName))
-				} else {
-					return nil
-				}
-			},
-		},
-		// rename
-		{
-			Forward: func() error {
-				return appRepo.RenameApplication(appName, venerableAppName(appName))
-			},
-		},
-		// push
-		{
-			Forward: func() error {
-				return appRepo.PushApplication(appName, manifestPath, appPath)
-			},
-			ReversePrevious: func() error {
-				// If the app cannot start we'll have a lingering application
-				// We delete this application so that the rename can succeed
-				appRepo.DeleteApplication(appName)
+	nextVersion := 1
+	if len(revisions) > 0 {
+		nextVersion = revisions[len(revisions)-1] + 1
+	}
+	revisionName := revisionAppName(appName, nextVersion)
 
-				return appRepo.RenameApplication(venerableAppName(appName), appName)
-			},
-		},
-		// delete/stop
-		{
-			Forward: func() error {
-				if(options.KeepExisting){
-					fmt.Println("Stopping old version of app. Remove the --keep-existing-app flag to delete it automatically.")
-					return appRepo.StopApplication(venerableAppName(appName))
-				} else {
-					fmt.Println("Deleting old version of app. Use the --keep-existing-app flag to preserve it.")
-					return appRepo.DeleteApplication(venerableAppName(appName))
-				}
-			},
-		},
+	actions := appendHookAction(nil, HookPrePush, hooks)
+
+	actions = append(actions, &RenameAction{Repo: appRepo, From: appName, To: revisionName})
+	actions = appendHookAction(actions, HookPostRename, hooks)
+
+	actions = append(actions, &PushAction{Repo: appRepo, AppName: appName, ManifestPath: manifestPath, AppPath: appPath, RevisionName: revisionName})
+	actions = appendHookAction(actions, HookPostPush, hooks)
+
+	if options.Wait {
+		actions = append(actions, &WaitAction{Repo: appRepo, AppName: appName, RevisionName: revisionName, Timeout: options.HealthTimeout})
 	}
-}
 
-func getActionsForNewApp(appRepo *ApplicationRepo, appName, manifestPath, appPath string) []rewind.Action {
-	return []rewind.Action{
-		// push
-		{
-			Forward: func() error {
-				return appRepo.PushApplication(appName, manifestPath, appPath)
-			},
-		},
+	actions = appendHookAction(actions, HookPreDeleteVenerable, hooks)
+
+	if options.KeepExisting {
+		actions = append(actions, &StopAction{Repo: appRepo, AppName: revisionName})
+		return append(actions, &PruneAction{Repo: appRepo, AppName: appName, MaxHistory: options.MaxHistory})
 	}
+
+	actions = append(actions, &DeleteAction{Repo: appRepo, AppName: revisionName})
+	return append(actions, &PruneAction{Repo: appRepo, AppName: appName, MaxHistory: options.MaxHistory})
+}
+
+func getActionsForNewApp(appRepo *ApplicationRepo, appName, manifestPath, appPath string, options AutopilotOptions) []Action {
+	hooks, err := loadHooksIfEnabled(options)
+	fatalIf(err)
+
+	actions := appendHookAction(nil, HookPrePush, hooks)
+	actions = append(actions, &PushAction{Repo: appRepo, AppName: appName, ManifestPath: manifestPath, AppPath: appPath})
+
+	return appendHookAction(actions, HookPostPush, hooks)
 }
 
 func (plugin AutopilotPlugin) Run(cliConnection plugin.CliConnection, args []string) {
+	logger = newLogger(detectLogFormat(args))
+
 	appRepo := NewApplicationRepo(cliConnection)
 
 	appName := args[1]
-	var actionList []rewind.Action
-	var	successMessage string
+	var actionList []Action
+	var dryRun bool
+	var successMessage string
 
-	if(args[0] == "zero-downtime-push") {
-		actionList = getActionsForPush(appRepo, args)
+	if args[0] == "zero-downtime-push" {
+		actionList, dryRun = getActionsForPush(appRepo, args)
 		successMessage = "A new version of your application has successfully been pushed!"
-	} else if (args[0] == "zero-downtime-rollback") {
-		appExists, err := appRepo.DoesAppExist(appName)
-		fatalIf(err)
-		venerableAppExists, err := appRepo.DoesAppExist(venerableAppName(appName))
+	} else if args[0] == "zero-downtime-canary" {
+		actionList, dryRun = getActionsForCanary(appRepo, args)
+		successMessage = "The canary rollout is complete, the new version is now fully live!"
+	} else if args[0] == "zero-downtime-rollback" {
+		appName, version, rollbackOptions, err := ParseRollbackArgs(args)
 		fatalIf(err)
+		dryRun = rollbackOptions.DryRun
 
-		if(!appExists){
+		appExists, err := appRepo.DoesAppExist(appName)
+		fatalIf(err)
+		if !appExists {
 			fatalIf(errors.New(fmt.Sprintf("Live version of app \"%s\" not found, cannot rollback.", appName)))
 		}
-		if(!venerableAppExists){
-			fatalIf(errors.New(fmt.Sprintf("Venerable version of \"%s\" not found, cannot rollback. Make sure you push with the " +
-			"--keep-existing-app flag to leave the venerable version behind.", appName)))
+
+		revisions, err := appRepo.ListRevisions(appName)
+		fatalIf(err)
+		if len(revisions) == 0 {
+			fatalIf(errors.New(fmt.Sprintf("No revision history for \"%s\" found, cannot rollback. Make sure you push with the "+
+				"--keep-existing-app flag to leave revisions behind.", appName)))
+		}
+
+		if version == 0 {
+			version = revisions[len(revisions)-1]
+		} else if !containsRevision(revisions, version) {
+			fatalIf(errors.New(fmt.Sprintf("Revision %d of \"%s\" not found, cannot rollback.", version, appName)))
 		}
-		actionList = getActionsForRollback(appName, appRepo, args)
+
+		actionList = getActionsForRollback(appName, version, appRepo, rollbackOptions)
 		successMessage = "Your application has been successfully rolled back!"
+	} else if args[0] == "zero-downtime-history" {
+		revisions, err := appRepo.ListRevisions(appName)
+		fatalIf(err)
+
+		if len(revisions) == 0 {
+			logger.Info(fmt.Sprintf("No revision history found for \"%s\".", appName))
+			return
+		}
+
+		logger.Info(fmt.Sprintf("Revision history for \"%s\":", appName))
+		for _, version := range revisions {
+			logger.Info(revisionAppName(appName, version))
+		}
+		return
+	}
+
+	if dryRun {
+		printDryRunPlan(actionList)
+		return
 	}
 
 	actions := rewind.Actions{
-		Actions:              actionList,
+		Actions:              toRewindActions(actionList),
 		RewindFailureMessage: "Oh no. Something's gone wrong. I've tried to roll back but you should check to see if everything is OK.",
 	}
 
 	err := actions.Execute()
 	fatalIf(err)
 
-	fmt.Println()
-	fmt.Println(successMessage)
-	fmt.Println()
+	logger.Info(successMessage)
 
 	err = appRepo.ListApplications()
 	fatalIf(err)
@@ -191,23 +971,37 @@ func (AutopilotPlugin) GetMetadata() plugin.PluginMetadata {
 		Name: "autopilot",
 		Version: plugin.VersionType{
 			Major: 0,
-			Minor: 0,
-			Build: 3,
+			Minor: 1,
+			Build: 0,
 		},
 		Commands: []plugin.Command{
 			{
 				Name:     "zero-downtime-push",
-				HelpText: "Perform a zero-downtime push of an application over the top of an old one",
+				HelpText: "Perform a zero-downtime push of an application over the top of an old one, keeping a numbered revision history",
+				UsageDetails: plugin.Usage{
+					Usage: "$ cf zero-downtime-push application-to-replace \\ \n \t-f path/to/new_manifest.yml \\ \n \t-p path/to/new/path \\ \n \t--max-history 3 \\ \n \t--dry-run \\ \n \t--wait --health-timeout 2m \\ \n \t--no-hooks \\ \n \t--strategy canary --steps 10,25,50,100 --step-interval 2m \\ \n \t--log-format text|json",
+				},
+			},
+			{
+				Name:     "zero-downtime-canary",
+				HelpText: "Gradually shift traffic from the live application to a newly pushed canary by shifting instance counts in steps",
 				UsageDetails: plugin.Usage{
-					Usage: "$ cf zero-downtime-push application-to-replace \\ \n \t-f path/to/new_manifest.yml \\ \n \t-p path/to/new/path",
+					Usage: "$ cf zero-downtime-canary application-to-replace \\ \n \t-f path/to/new_manifest.yml \\ \n \t--steps 10,25,50,100 --step-interval 2m",
 				},
 			},
 			{
-				Name:"zero-downtime-rollback",
-				HelpText: "Perform a zero-downtime rollback to the previous version of the application. Requires that the previous, 'venerable' version of the app still exists." +
+				Name: "zero-downtime-rollback",
+				HelpText: "Perform a zero-downtime rollback to a previous revision of the application. Requires that revision history for the app still exists." +
 					"Use the --keep-existing-app flag when performing a zero-downtime-push to ensure this.",
-				UsageDetails:plugin.Usage{
-					Usage:"$cf zero-downtime-rollback application-to-revert",
+				UsageDetails: plugin.Usage{
+					Usage: "$ cf zero-downtime-rollback application-to-revert --version N --dry-run --no-hooks --log-format text|json",
+				},
+			},
+			{
+				Name:     "zero-downtime-history",
+				HelpText: "List the revision history retained for an application",
+				UsageDetails: plugin.Usage{
+					Usage: "$ cf zero-downtime-history application-name",
 				},
 			},
 		},
@@ -219,6 +1013,18 @@ func ParseArgs(args []string) (string, string, string, AutopilotOptions, error)
 	manifestPath := flags.String("f", "", "path to an application manifest")
 	appPath := flags.String("p", "", "path to application files")
 	keepVenerable := flags.Bool("keep-existing-app", false, "keep existing app running")
+	maxHistory := flags.Int("max-history", 3, "number of previous revisions to retain")
+	dryRun := flags.Bool("dry-run", false, "print the steps that would be taken without running them (read-only CF API lookups still run)")
+	wait := flags.Bool("wait", false, "wait for the new app's instances to report RUNNING before removing the previous revision")
+	healthTimeout := flags.Duration("health-timeout", 60*time.Second, "how long --wait waits for instances to become healthy before rolling back")
+	noHooks := flags.Bool("no-hooks", false, "disable pre-push/post-rename/post-push/pre-delete-venerable hooks")
+	strategy := flags.String("strategy", "rename", "push strategy: rename (atomic cutover) or canary (gradual traffic shift)")
+	steps := flags.String("steps", "10,25,50,100", "comma-separated instance percentages for each --strategy=canary step")
+	stepInterval := flags.Duration("step-interval", 2*time.Minute, "how long to let traffic settle between --strategy=canary steps")
+	// --log-format is actually read by detectLogFormat before flags are
+	// parsed (see Run); it's registered here only so flags.Parse doesn't
+	// reject it as unknown.
+	flags.String("log-format", "text", "output format for progress and events: text or json")
 
 	err := flags.Parse(args[2:])
 	if err != nil {
@@ -231,11 +1037,65 @@ func ParseArgs(args []string) (string, string, string, AutopilotOptions, error)
 		return "", "", "", AutopilotOptions{}, ErrNoManifest
 	}
 
-	options := AutopilotOptions{KeepExisting: *keepVenerable}
+	if *maxHistory < 0 {
+		return "", "", "", AutopilotOptions{}, fmt.Errorf("--max-history must be >= 0, got %d", *maxHistory)
+	}
+
+	canarySteps, err := parseCanarySteps(*steps)
+	if err != nil {
+		return "", "", "", AutopilotOptions{}, err
+	}
+
+	options := AutopilotOptions{
+		KeepExisting:  *keepVenerable,
+		MaxHistory:    *maxHistory,
+		DryRun:        *dryRun,
+		Wait:          *wait,
+		HealthTimeout: *healthTimeout,
+		ManifestPath:  *manifestPath,
+		DisableHooks:  *noHooks,
+		Strategy:      *strategy,
+		CanarySteps:   canarySteps,
+		StepInterval:  *stepInterval,
+	}
 
 	return appName, *manifestPath, *appPath, options, nil
 }
 
+func ParseRollbackArgs(args []string) (string, int, AutopilotOptions, error) {
+	flags := flag.NewFlagSet("zero-downtime-rollback", flag.ContinueOnError)
+	version := flags.Int("version", 0, "revision number to roll back to (defaults to the most recent revision)")
+	dryRun := flags.Bool("dry-run", false, "print the steps that would be taken without running them (read-only CF API lookups still run)")
+	manifestPath := flags.String("f", "", "path to an application manifest, used only to locate hook configuration")
+	noHooks := flags.Bool("no-hooks", false, "disable pre-rollback/post-rollback hooks")
+	// --log-format is actually read by detectLogFormat before flags are
+	// parsed (see Run); it's registered here only so flags.Parse doesn't
+	// reject it as unknown.
+	flags.String("log-format", "text", "output format for progress and events: text or json")
+
+	err := flags.Parse(args[2:])
+	if err != nil {
+		return "", 0, AutopilotOptions{}, err
+	}
+
+	options := AutopilotOptions{
+		DryRun:       *dryRun,
+		ManifestPath: *manifestPath,
+		DisableHooks: *noHooks,
+	}
+
+	return args[1], *version, options, nil
+}
+
+func containsRevision(revisions []int, version int) bool {
+	for _, candidate := range revisions {
+		if candidate == version {
+			return true
+		}
+	}
+	return false
+}
+
 var ErrNoManifest = errors.New("a manifest is required to push this application")
 
 type ApplicationRepo struct {
@@ -243,7 +1103,16 @@ type ApplicationRepo struct {
 }
 
 type AutopilotOptions struct {
-	KeepExisting bool
+	KeepExisting  bool
+	MaxHistory    int
+	DryRun        bool
+	Wait          bool
+	HealthTimeout time.Duration
+	ManifestPath  string
+	DisableHooks  bool
+	Strategy      string
+	CanarySteps   []int
+	StepInterval  time.Duration
 }
 
 func NewApplicationRepo(conn plugin.CliConnection) *ApplicationRepo {
@@ -252,40 +1121,52 @@ func NewApplicationRepo(conn plugin.CliConnection) *ApplicationRepo {
 	}
 }
 
-func (repo *ApplicationRepo) RenameApplication(oldName, newName string) error {
-	_, err := repo.conn.CliCommand("rename", oldName, newName)
+// runCF runs a cf CLI command and routes its output through logger instead
+// of writing straight to the real stdout, so --log-format json gets a clean
+// stream of JSON events rather than a mix of JSON and raw CLI text.
+func (repo *ApplicationRepo) runCF(args ...string) error {
+	lines, err := repo.conn.CliCommandWithoutTerminalOutput(args...)
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		logger.Info(line)
+	}
 	return err
 }
 
-func (repo *ApplicationRepo) PushApplication(appName, manifestPath, appPath string) error {
+func (repo *ApplicationRepo) RenameApplication(oldName, newName string) error {
+	return repo.runCF("rename", oldName, newName)
+}
+
+func (repo *ApplicationRepo) PushApplication(appName, manifestPath, appPath string, noRoute bool) error {
 	args := []string{"push", appName, "-f", manifestPath}
 
 	if appPath != "" {
 		args = append(args, "-p", appPath)
 	}
 
-	_, err := repo.conn.CliCommand(args...)
-	return err
+	if noRoute {
+		args = append(args, "--no-route")
+	}
+
+	return repo.runCF(args...)
 }
 
 func (repo *ApplicationRepo) DeleteApplication(appName string) error {
-	_, err := repo.conn.CliCommand("delete", appName, "-f")
-	return err
+	return repo.runCF("delete", appName, "-f")
 }
 
 func (repo *ApplicationRepo) StartApplication(appName string) error {
-	_, err := repo.conn.CliCommand("start", appName)
-	return err
+	return repo.runCF("start", appName)
 }
 
 func (repo *ApplicationRepo) StopApplication(appName string) error {
-	_, err := repo.conn.CliCommand("stop", appName)
-	return err
+	return repo.runCF("stop", appName)
 }
 
 func (repo *ApplicationRepo) ListApplications() error {
-	_, err := repo.conn.CliCommand("apps")
-	return err
+	return repo.runCF("apps")
 }
 
 func (repo *ApplicationRepo) DoesAppExist(appName string) (bool, error) {
@@ -324,3 +1205,285 @@ func (repo *ApplicationRepo) DoesAppExist(appName string) (bool, error) {
 
 	return count == 1, nil
 }
+
+const healthCheckInterval = 2 * time.Second
+
+func (repo *ApplicationRepo) getAppGUID(appName string) (string, error) {
+	space, err := repo.conn.GetCurrentSpace()
+	if err != nil {
+		return "", err
+	}
+
+	path := fmt.Sprintf(`v2/apps?q=name:%s&q=space_guid:%s`, appName, space.Guid)
+	result, err := repo.conn.CliCommandWithoutTerminalOutput("curl", path)
+	if err != nil {
+		return "", err
+	}
+
+	var output struct {
+		Resources []struct {
+			Metadata struct {
+				Guid string `json:"guid"`
+			} `json:"metadata"`
+		} `json:"resources"`
+	}
+
+	if err := json.Unmarshal([]byte(strings.Join(result, "")), &output); err != nil {
+		return "", err
+	}
+
+	if len(output.Resources) == 0 {
+		return "", fmt.Errorf("app %q not found", appName)
+	}
+
+	return output.Resources[0].Metadata.Guid, nil
+}
+
+// WaitForHealthy polls appName's instance stats until every instance reports
+// RUNNING, or returns an error once timeout has elapsed.
+func (repo *ApplicationRepo) WaitForHealthy(appName string, timeout time.Duration) error {
+	guid, err := repo.getAppGUID(appName)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		result, err := repo.conn.CliCommandWithoutTerminalOutput("curl", fmt.Sprintf("v2/apps/%s/stats", guid))
+		if err != nil {
+			return err
+		}
+
+		var stats map[string]struct {
+			State string `json:"state"`
+		}
+
+		if err := json.Unmarshal([]byte(strings.Join(result, "")), &stats); err != nil {
+			return err
+		}
+
+		allRunning := len(stats) > 0
+		for _, instance := range stats {
+			if instance.State != "RUNNING" {
+				allRunning = false
+				break
+			}
+		}
+
+		if allRunning {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s waiting for %s to become healthy", timeout, appName)
+		}
+
+		time.Sleep(healthCheckInterval)
+	}
+}
+
+// Route is a single host/domain/path mapping on a CF app.
+type Route struct {
+	Domain   string
+	Hostname string
+	Path     string
+}
+
+func (r Route) String() string {
+	if r.Hostname == "" {
+		return r.Domain + r.Path
+	}
+	return r.Hostname + "." + r.Domain + r.Path
+}
+
+func (repo *ApplicationRepo) getAppInstanceCount(appName string) (int, error) {
+	guid, err := repo.getAppGUID(appName)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := repo.conn.CliCommandWithoutTerminalOutput("curl", fmt.Sprintf("v2/apps/%s", guid))
+	if err != nil {
+		return 0, err
+	}
+
+	var output struct {
+		Entity struct {
+			Instances int `json:"instances"`
+		} `json:"entity"`
+	}
+
+	if err := json.Unmarshal([]byte(strings.Join(result, "")), &output); err != nil {
+		return 0, err
+	}
+
+	return output.Entity.Instances, nil
+}
+
+func (repo *ApplicationRepo) getDomainName(domainGUID string) (string, error) {
+	result, err := repo.conn.CliCommandWithoutTerminalOutput("curl", fmt.Sprintf("v2/shared_domains/%s", domainGUID))
+	if err != nil {
+		return "", err
+	}
+
+	var output struct {
+		Entity struct {
+			Name string `json:"name"`
+		} `json:"entity"`
+	}
+
+	if err := json.Unmarshal([]byte(strings.Join(result, "")), &output); err != nil {
+		return "", err
+	}
+
+	return output.Entity.Name, nil
+}
+
+// GetAppRoutes returns every route currently mapped to appName.
+func (repo *ApplicationRepo) GetAppRoutes(appName string) ([]Route, error) {
+	guid, err := repo.getAppGUID(appName)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := repo.conn.CliCommandWithoutTerminalOutput("curl", fmt.Sprintf("v2/apps/%s/routes", guid))
+	if err != nil {
+		return nil, err
+	}
+
+	var output struct {
+		Resources []struct {
+			Entity struct {
+				Host       string `json:"host"`
+				Path       string `json:"path"`
+				DomainGuid string `json:"domain_guid"`
+			} `json:"entity"`
+		} `json:"resources"`
+	}
+
+	if err := json.Unmarshal([]byte(strings.Join(result, "")), &output); err != nil {
+		return nil, err
+	}
+
+	routes := make([]Route, 0, len(output.Resources))
+	for _, resource := range output.Resources {
+		domain, err := repo.getDomainName(resource.Entity.DomainGuid)
+		if err != nil {
+			return nil, err
+		}
+
+		routes = append(routes, Route{Domain: domain, Hostname: resource.Entity.Host, Path: resource.Entity.Path})
+	}
+
+	return routes, nil
+}
+
+func routeArgs(command, appName string, route Route) []string {
+	args := []string{command, appName, route.Domain}
+
+	if route.Hostname != "" {
+		args = append(args, "--hostname", route.Hostname)
+	}
+	if route.Path != "" {
+		args = append(args, "--path", route.Path)
+	}
+
+	return args
+}
+
+func (repo *ApplicationRepo) MapRoute(appName string, route Route) error {
+	return repo.runCF(routeArgs("map-route", appName, route)...)
+}
+
+func (repo *ApplicationRepo) UnmapRoute(appName string, route Route) error {
+	return repo.runCF(routeArgs("unmap-route", appName, route)...)
+}
+
+func (repo *ApplicationRepo) ScaleApplication(appName string, instances int) error {
+	return repo.runCF("scale", appName, "-i", strconv.Itoa(instances), "-f")
+}
+
+var revisionNamePattern = regexp.MustCompile(`-v(\d+)$`)
+
+// ListRevisions returns the version numbers of every revision of appName
+// that autopilot has left behind, sorted oldest to newest.
+func (repo *ApplicationRepo) ListRevisions(appName string) ([]int, error) {
+	space, err := repo.conn.GetCurrentSpace()
+	if err != nil {
+		return nil, err
+	}
+
+	// The v2 API's name filter is exact-match only (no glob/wildcard support),
+	// so we fetch every app in the space and filter client-side by prefix
+	// and revisionNamePattern below.
+	path := fmt.Sprintf(`v2/apps?q=space_guid:%s`, space.Guid)
+	result, err := repo.conn.CliCommandWithoutTerminalOutput("curl", path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	jsonResp := strings.Join(result, "")
+
+	var output struct {
+		Resources []struct {
+			Entity struct {
+				Name string `json:"name"`
+			} `json:"entity"`
+		} `json:"resources"`
+	}
+
+	err = json.Unmarshal([]byte(jsonResp), &output)
+	if err != nil {
+		return nil, err
+	}
+
+	expectedPrefix := appName + "-v"
+	var revisions []int
+	for _, resource := range output.Resources {
+		if !strings.HasPrefix(resource.Entity.Name, expectedPrefix) {
+			continue
+		}
+
+		matches := revisionNamePattern.FindStringSubmatch(resource.Entity.Name)
+		if matches == nil {
+			continue
+		}
+
+		version, err := strconv.Atoi(matches[1])
+		if err != nil || resource.Entity.Name != revisionAppName(appName, version) {
+			continue
+		}
+
+		revisions = append(revisions, version)
+	}
+
+	sort.Ints(revisions)
+
+	return revisions, nil
+}
+
+// PruneRevisions deletes the oldest revisions of appName until at most max remain.
+func (repo *ApplicationRepo) PruneRevisions(appName string, max int) error {
+	if max < 0 {
+		max = 0
+	}
+
+	revisions, err := repo.ListRevisions(appName)
+	if err != nil {
+		return err
+	}
+
+	if len(revisions) <= max {
+		return nil
+	}
+
+	for _, version := range revisions[:len(revisions)-max] {
+		if err := repo.DeleteApplication(revisionAppName(appName, version)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/cli/plugin"
+	plugin_models "github.com/cloudfoundry/cli/plugin/models"
+)
+
+func TestRevisionAppName(t *testing.T) {
+	cases := []struct {
+		appName string
+		version int
+		want    string
+	}{
+		{"my-app", 1, "my-app-v1"},
+		{"my-app", 12, "my-app-v12"},
+	}
+
+	for _, c := range cases {
+		if got := revisionAppName(c.appName, c.version); got != c.want {
+			t.Errorf("revisionAppName(%q, %d) = %q, want %q", c.appName, c.version, got, c.want)
+		}
+	}
+}
+
+func TestRollbackAppName(t *testing.T) {
+	if got, want := rollbackAppName("my-app"), "my-app-rollback"; got != want {
+		t.Errorf("rollbackAppName(%q) = %q, want %q", "my-app", got, want)
+	}
+}
+
+func TestParseArgsRejectsNegativeMaxHistory(t *testing.T) {
+	_, _, _, _, err := ParseArgs([]string{"zero-downtime-push", "my-app", "-f", "manifest.yml", "--max-history", "-1"})
+	if err == nil {
+		t.Fatal("ParseArgs with --max-history -1 expected an error, got nil")
+	}
+}
+
+func TestActionDescribeAndDescribeReverse(t *testing.T) {
+	rename := &RenameAction{From: "my-app", To: "my-app-v1"}
+	if got, want := rename.Describe(), "rename my-app -> my-app-v1"; got != want {
+		t.Errorf("RenameAction.Describe() = %q, want %q", got, want)
+	}
+	if got, want := rename.DescribeReverse(), "rename my-app-v1 -> my-app"; got != want {
+		t.Errorf("RenameAction.DescribeReverse() = %q, want %q", got, want)
+	}
+
+	push := &PushAction{AppName: "my-app", ManifestPath: "manifest.yml", RevisionName: "my-app-v1"}
+	if got, want := push.Describe(), "push my-app from manifest manifest.yml"; got != want {
+		t.Errorf("PushAction.Describe() = %q, want %q", got, want)
+	}
+	if got, want := push.DescribeReverse(), "delete my-app and rename my-app-v1 -> my-app"; got != want {
+		t.Errorf("PushAction.DescribeReverse() = %q, want %q", got, want)
+	}
+
+	canaryPush := &PushAction{AppName: "my-app-canary", ManifestPath: "manifest.yml", NoRoute: true, DeleteOnReverse: true}
+	if got, want := canaryPush.Describe(), "push my-app-canary from manifest manifest.yml (no route)"; got != want {
+		t.Errorf("PushAction.Describe() (canary) = %q, want %q", got, want)
+	}
+	if got, want := canaryPush.DescribeReverse(), "delete my-app-canary"; got != want {
+		t.Errorf("PushAction.DescribeReverse() (canary) = %q, want %q", got, want)
+	}
+
+	stop := &StopAction{AppName: "my-app-v1"}
+	if got, want := stop.Describe(), "stop my-app-v1"; got != want {
+		t.Errorf("StopAction.Describe() = %q, want %q", got, want)
+	}
+	if got := stop.DescribeReverse(); got != "" {
+		t.Errorf("StopAction.DescribeReverse() = %q, want empty", got)
+	}
+}
+
+func TestPrintDryRunPlan(t *testing.T) {
+	plan := []Action{
+		&RenameAction{From: "my-app", To: "my-app-v1"},
+		&StopAction{AppName: "my-app-v1"},
+	}
+
+	output := captureStdout(t, func() {
+		printDryRunPlan(plan)
+	})
+
+	want := "Dry run: the following steps would be performed (no API calls will be made):\n" +
+		"  1. rename my-app -> my-app-v1\n" +
+		"     on failure: rename my-app-v1 -> my-app\n" +
+		"  2. stop my-app-v1\n"
+	if output != want {
+		t.Errorf("printDryRunPlan output = %q, want %q", output, want)
+	}
+}
+
+func TestContainsRevision(t *testing.T) {
+	cases := []struct {
+		revisions []int
+		version   int
+		want      bool
+	}{
+		{[]int{1, 2, 3}, 2, true},
+		{[]int{1, 2, 3}, 4, false},
+		{nil, 1, false},
+	}
+
+	for _, c := range cases {
+		if got := containsRevision(c.revisions, c.version); got != c.want {
+			t.Errorf("containsRevision(%v, %d) = %v, want %v", c.revisions, c.version, got, c.want)
+		}
+	}
+}
+
+func TestRevisionNamePattern(t *testing.T) {
+	cases := []struct {
+		name      string
+		wantMatch bool
+		wantGroup string
+	}{
+		{"my-app-v1", true, "1"},
+		{"my-app-v42", true, "42"},
+		{"my-app-venerable", false, ""},
+		{"my-app-v1-staging", false, ""},
+	}
+
+	for _, c := range cases {
+		matches := revisionNamePattern.FindStringSubmatch(c.name)
+		if c.wantMatch && matches == nil {
+			t.Errorf("revisionNamePattern did not match %q, expected it to", c.name)
+			continue
+		}
+		if !c.wantMatch && matches != nil {
+			t.Errorf("revisionNamePattern matched %q, expected no match", c.name)
+			continue
+		}
+		if c.wantMatch && matches[1] != c.wantGroup {
+			t.Errorf("revisionNamePattern matched %q with group %q, want %q", c.name, matches[1], c.wantGroup)
+		}
+	}
+}
+
+func TestHookPointFromEnvKey(t *testing.T) {
+	cases := []struct {
+		key       string
+		wantPoint HookPoint
+		wantOK    bool
+	}{
+		{"AUTOPILOT_HOOKS_PRE_PUSH", HookPrePush, true},
+		{"AUTOPILOT_HOOKS_POST_DELETE_VENERABLE", HookPoint("post-delete-venerable"), true},
+		{"SOME_OTHER_ENV_VAR", "", false},
+	}
+
+	for _, c := range cases {
+		point, ok := hookPointFromEnvKey(c.key)
+		if ok != c.wantOK || point != c.wantPoint {
+			t.Errorf("hookPointFromEnvKey(%q) = (%q, %v), want (%q, %v)", c.key, point, ok, c.wantPoint, c.wantOK)
+		}
+	}
+}
+
+func TestLoadHooksMergesManifestEnvAndSidecar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autopilot-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifestPath := filepath.Join(dir, "manifest.yml")
+	manifest := "applications:\n" +
+		"- name: my-app\n" +
+		"  env:\n" +
+		"    AUTOPILOT_HOOKS_PRE_PUSH: ./migrate.sh\n" +
+		"    AUTOPILOT_HOOKS_POST_PUSH: ./warm-cache.sh\n"
+	if err := ioutil.WriteFile(manifestPath, []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sidecar := "hooks:\n" +
+		"  post-push:\n" +
+		"  - ./smoke-test.sh\n" +
+		"  pre-rollback:\n" +
+		"  - ./notify.sh\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "autopilot.yml"), []byte(sidecar), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hooks, err := LoadHooks(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[HookPoint][]string{
+		HookPrePush:     {"./migrate.sh"},
+		HookPostPush:    {"./warm-cache.sh", "./smoke-test.sh"},
+		HookPreRollback: {"./notify.sh"},
+	}
+	if !reflect.DeepEqual(hooks, want) {
+		t.Errorf("LoadHooks() = %v, want %v", hooks, want)
+	}
+}
+
+func TestLoadHooksNoManifestPath(t *testing.T) {
+	hooks, err := LoadHooks("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != 0 {
+		t.Errorf("LoadHooks(\"\") = %v, want empty", hooks)
+	}
+}
+
+func TestLoadHooksIfEnabledRespectsDisableHooks(t *testing.T) {
+	hooks, err := loadHooksIfEnabled(AutopilotOptions{DisableHooks: true, ManifestPath: "irrelevant.yml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != 0 {
+		t.Errorf("loadHooksIfEnabled with DisableHooks = %v, want empty", hooks)
+	}
+}
+
+func TestScaledInstances(t *testing.T) {
+	cases := []struct {
+		total, pct, want int
+	}{
+		{10, 10, 1},
+		{10, 25, 3},
+		{10, 50, 5},
+		{10, 100, 10},
+		{1, 10, 1},
+		{10, 0, 1},
+		{10, 150, 10},
+	}
+
+	for _, c := range cases {
+		if got := scaledInstances(c.total, c.pct); got != c.want {
+			t.Errorf("scaledInstances(%d, %d) = %d, want %d", c.total, c.pct, got, c.want)
+		}
+	}
+}
+
+func TestParseCanarySteps(t *testing.T) {
+	steps, err := parseCanarySteps("10,25,50,100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int{10, 25, 50, 100}
+	if !reflect.DeepEqual(steps, want) {
+		t.Errorf("parseCanarySteps(%q) = %v, want %v", "10,25,50,100", steps, want)
+	}
+
+	steps, err = parseCanarySteps(" 10 , 50 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{10, 50}; !reflect.DeepEqual(steps, want) {
+		t.Errorf("parseCanarySteps with whitespace = %v, want %v", steps, want)
+	}
+
+	if _, err := parseCanarySteps("10,abc,50"); err == nil {
+		t.Error("parseCanarySteps(\"10,abc,50\") expected an error, got nil")
+	}
+}
+
+func TestCanaryAppName(t *testing.T) {
+	if got, want := canaryAppName("my-app"), "my-app-canary"; got != want {
+		t.Errorf("canaryAppName(%q) = %q, want %q", "my-app", got, want)
+	}
+}
+
+func TestDetectLogFormat(t *testing.T) {
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"zero-downtime-push", "my-app", "-f", "manifest.yml"}, "text"},
+		{[]string{"zero-downtime-push", "my-app", "--log-format", "json"}, "json"},
+		{[]string{"zero-downtime-push", "my-app", "--log-format=json"}, "json"},
+		{[]string{"zero-downtime-push", "my-app", "-log-format", "json"}, "json"},
+		{[]string{"zero-downtime-push", "my-app", "-log-format=json"}, "json"},
+	}
+
+	for _, c := range cases {
+		if got := detectLogFormat(c.args); got != c.want {
+			t.Errorf("detectLogFormat(%v) = %q, want %q", c.args, got, c.want)
+		}
+	}
+}
+
+// captureStdout runs fn with os.Stdout redirected to a pipe and returns
+// everything fn wrote to it.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+
+	real := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+
+	fn()
+
+	w.Close()
+	os.Stdout = real
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestJSONLoggerStepShapesFields(t *testing.T) {
+	output := captureStdout(t, func() {
+		jsonLogger{}.Step("rename", "ok", map[string]interface{}{
+			"from":   "foo",
+			"to":     "foo-v1",
+			"status": "should-be-overridden",
+		})
+	})
+
+	var event map[string]interface{}
+	if err := json.Unmarshal([]byte(output), &event); err != nil {
+		t.Fatalf("Step output %q is not valid JSON: %s", output, err)
+	}
+
+	want := map[string]interface{}{
+		"action": "rename",
+		"status": "ok",
+		"from":   "foo",
+		"to":     "foo-v1",
+	}
+	if !reflect.DeepEqual(event, want) {
+		t.Errorf("jsonLogger.Step event = %v, want %v", event, want)
+	}
+}
+
+func TestTextLoggerStepOnlyPrintsMessageField(t *testing.T) {
+	output := captureStdout(t, func() {
+		textLogger{}.Step("prune", "ok", map[string]interface{}{"message": "Pruning revisions of my-app beyond the last 3."})
+	})
+	if want := "Pruning revisions of my-app beyond the last 3.\n"; output != want {
+		t.Errorf("textLogger.Step output = %q, want %q", output, want)
+	}
+
+	silent := captureStdout(t, func() {
+		textLogger{}.Step("rename", "ok", map[string]interface{}{"from": "foo", "to": "foo-v1"})
+	})
+	if silent != "" {
+		t.Errorf("textLogger.Step output = %q, want empty for a fields map with no message", silent)
+	}
+}
+
+// fakeCliConnection embeds plugin.CliConnection so it satisfies the full
+// interface without stubbing every method, overriding only what
+// WaitForHealthy actually calls.
+type fakeCliConnection struct {
+	plugin.CliConnection
+	statsResponse string
+}
+
+func (c *fakeCliConnection) GetCurrentSpace() (plugin_models.Space, error) {
+	return plugin_models.Space{SpaceFields: plugin_models.SpaceFields{Guid: "space-guid"}}, nil
+}
+
+func (c *fakeCliConnection) CliCommandWithoutTerminalOutput(args ...string) ([]string, error) {
+	path := args[len(args)-1]
+	switch {
+	case strings.Contains(path, "/stats"):
+		return []string{c.statsResponse}, nil
+	default:
+		return []string{`{"resources":[{"metadata":{"guid":"app-guid"}}]}`}, nil
+	}
+}
+
+func TestWaitForHealthyTimesOutWhenInstanceNeverRuns(t *testing.T) {
+	repo := NewApplicationRepo(&fakeCliConnection{
+		statsResponse: `{"0":{"state":"STARTING"}}`,
+	})
+
+	err := repo.WaitForHealthy("my-app", 0)
+	if err == nil {
+		t.Fatal("WaitForHealthy with an instance stuck at STARTING expected a timeout error, got nil")
+	}
+}
+
+func TestWaitForHealthySucceedsWhenAllInstancesRunning(t *testing.T) {
+	repo := NewApplicationRepo(&fakeCliConnection{
+		statsResponse: `{"0":{"state":"RUNNING"},"1":{"state":"RUNNING"}}`,
+	})
+
+	if err := repo.WaitForHealthy("my-app", time.Second); err != nil {
+		t.Errorf("WaitForHealthy with all instances RUNNING = %v, want nil", err)
+	}
+}